@@ -0,0 +1,224 @@
+package redisc
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// errConnClosed is the sticky error returned by a Conn once it has been
+// closed.
+var errConnClosed = errors.New("redisc: connection closed")
+
+// Conn is a redis.Conn that dispatches its commands to the cluster node
+// serving the relevant hash slot. A Conn is not safe for concurrent use by
+// multiple goroutines, same as a plain redigo connection.
+//
+// By default, a Conn binds itself lazily to the node serving the slot of
+// the first key it is asked to operate on (the first argument of the
+// first Do/Send call). Bind can be called explicitly beforehand to force
+// that binding to a specific key (or set of keys, which must all hash to
+// the same slot), which is useful for commands such as MULTI/EXEC whose
+// own arguments don't carry a key.
+//
+// Once bound, a Conn always targets the same node; redirections (MOVED,
+// ASK) returned by that node are surfaced as a normal error from
+// Do/Receive, inspectable with ParseRedir, and are not followed
+// automatically. Wrap the Conn with RetryConn to follow them.
+type Conn struct {
+	cluster *Cluster
+
+	rc       redis.Conn
+	addr     string
+	slot     int
+	readOnly bool
+	err      error
+}
+
+// ReadOnly marks the connection as eligible to serve read-only commands
+// (as classified by IsReadCommand) from a replica, according to the
+// cluster's ReadPreference, instead of always using the slot's primary.
+// It sends the redis READONLY command on the underlying connection if
+// one is already bound; otherwise the connection picks up the read-only
+// state when it binds on the first Do/Send call.
+func (c *Conn) ReadOnly() error {
+	if c.err != nil {
+		return c.err
+	}
+	c.readOnly = true
+	if c.rc != nil {
+		_, err := c.rc.Do("READONLY")
+		return err
+	}
+	return nil
+}
+
+// Bind binds the connection to the node serving the hash slot of keys,
+// which must all map to the same slot. It must be called before the
+// connection is used, and at most once.
+func (c *Conn) Bind(keys ...string) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.rc != nil {
+		return errors.New("redisc: connection already bound")
+	}
+	if len(keys) == 0 {
+		return errors.New("redisc: Bind requires at least one key")
+	}
+
+	slot := keyHashSlot(keys[0])
+	for _, k := range keys[1:] {
+		if keyHashSlot(k) != slot {
+			return errors.New("redisc: all keys must belong to the same slot")
+		}
+	}
+	return c.bindSlot(slot, "")
+}
+
+// bindSlot binds the connection to the node serving slot: the slot's
+// primary, unless the connection is read-only and cmd is a read command,
+// in which case the node is chosen according to the cluster's
+// ReadPreference.
+func (c *Conn) bindSlot(slot int, cmd string) error {
+	addr := c.addrForCmd(slot, cmd)
+	if addr == "" {
+		return errors.New("redisc: no node known for slot, call Cluster.Refresh first")
+	}
+
+	rc, err := c.cluster.getConnForAddr(addr, false)
+	if err != nil {
+		return err
+	}
+	if c.readOnly && IsReadCommand(cmd) {
+		if _, err := rc.Do("READONLY"); err != nil {
+			rc.Close()
+			return err
+		}
+	}
+	c.rc = rc
+	c.addr = addr
+	c.slot = slot
+	return nil
+}
+
+// addrForCmd returns the node address to use for cmd targeting slot,
+// taking the connection's read-only state and the cluster's
+// ReadPreference into account.
+func (c *Conn) addrForCmd(slot int, cmd string) string {
+	if c.readOnly && IsReadCommand(cmd) {
+		if addr := c.cluster.pickReadAddr(slot, c.cluster.ReadPreference); addr != "" {
+			return addr
+		}
+	}
+	addr := c.cluster.addrForSlot(slot)
+	if addr == "" {
+		addr = c.cluster.randomAddr()
+	}
+	return addr
+}
+
+// autoBind binds the connection based on the first of args, if it looks
+// like a command's key, the first time the connection is used without an
+// explicit call to Bind.
+func (c *Conn) autoBind(cmd string, args []interface{}) error {
+	slot := 0
+	if len(args) > 0 {
+		if key, ok := args[0].(string); ok {
+			slot = keyHashSlot(key)
+		}
+	}
+	return c.bindSlot(slot, cmd)
+}
+
+// Do sends cmd with args to the bound node and returns its reply. If the
+// connection isn't bound yet, it binds based on the slot of args[0].
+func (c *Conn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.rc == nil {
+		if err := c.autoBind(cmd, args); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	v, err := c.rc.Do(cmd, args...)
+	c.cluster.recordLatency(c.addr, time.Since(start), err)
+	c.noteRedir(err)
+	return v, err
+}
+
+// Send queues cmd with args for the bound node, to be flushed with Flush
+// and read with Receive.
+func (c *Conn) Send(cmd string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.rc == nil {
+		if err := c.autoBind(cmd, args); err != nil {
+			return err
+		}
+	}
+	return c.rc.Send(cmd, args...)
+}
+
+// Flush flushes the output buffer of the bound connection.
+func (c *Conn) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.rc == nil {
+		return nil
+	}
+	return c.rc.Flush()
+}
+
+// Receive reads a single reply from the bound connection.
+func (c *Conn) Receive() (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.rc == nil {
+		return nil, errors.New("redisc: connection not bound")
+	}
+	v, err := c.rc.Receive()
+	c.noteRedir(err)
+	return v, err
+}
+
+// Err returns a non-nil error if the connection is broken, closed, or
+// could not be bound.
+func (c *Conn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.rc != nil {
+		return c.rc.Err()
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	if c.err != nil {
+		return c.err
+	}
+	c.err = errConnClosed
+	if c.rc != nil {
+		return c.rc.Close()
+	}
+	return nil
+}
+
+// noteRedir updates the cluster's slot mapping when err is a MOVED
+// redirection, regardless of whether the caller goes on to follow it -
+// the cluster's topology has changed either way, so there's no reason to
+// wait for a full Refresh to learn about it.
+func (c *Conn) noteRedir(err error) {
+	if re := ParseRedir(err); re != nil && re.Type == "MOVED" {
+		c.cluster.setAddrForSlot(re.Slot, re.Addr)
+	}
+}
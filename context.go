@@ -0,0 +1,88 @@
+package redisc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ConnWithContext is implemented by connections that support context-
+// bound operations: the Do/Send/Receive trio, each taking a
+// context.Context whose deadline (if any) bounds the call - including,
+// for RetryConnContext, every MOVED/ASK/TRYAGAIN retry it takes along the
+// way - and whose cancellation aborts the call as soon as it is noticed.
+type ConnWithContext interface {
+	DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
+	SendContext(ctx context.Context, cmd string, args ...interface{}) error
+	ReceiveContext(ctx context.Context) (interface{}, error)
+}
+
+// DoContext behaves like Do, except that ctx's deadline, if any, bounds
+// the underlying redigo call (via redis.DoWithTimeout), and ctx.Err() is
+// returned if ctx is already done.
+func (c *Conn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.rc == nil {
+		if err := c.autoBind(cmd, args); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	v, err := doWithContext(ctx, c.rc, cmd, args...)
+	c.cluster.recordLatency(c.addr, time.Since(start), err)
+	c.noteRedir(err)
+	return v, err
+}
+
+// SendContext behaves like Send, except it returns ctx.Err() immediately
+// if ctx is already done instead of queuing the command.
+func (c *Conn) SendContext(ctx context.Context, cmd string, args ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Send(cmd, args...)
+}
+
+// ReceiveContext behaves like Receive, except that ctx's deadline, if
+// any, bounds the wait for a reply (via redis.ReceiveWithTimeout).
+func (c *Conn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.rc == nil {
+		return nil, errors.New("redisc: connection not bound")
+	}
+
+	v, err := receiveWithContext(ctx, c.rc)
+	c.noteRedir(err)
+	return v, err
+}
+
+// doWithContext executes cmd against conn, bounding it with ctx's
+// deadline via redis.DoWithTimeout when one is set.
+func doWithContext(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		return redis.DoWithTimeout(conn, time.Until(dl), cmd, args...)
+	}
+	return conn.Do(cmd, args...)
+}
+
+// receiveWithContext reads the next reply from conn, bounding the wait
+// with ctx's deadline via redis.ReceiveWithTimeout when one is set.
+func receiveWithContext(ctx context.Context, conn redis.Conn) (interface{}, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		return redis.ReceiveWithTimeout(conn, time.Until(dl))
+	}
+	return conn.Receive()
+}
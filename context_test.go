@@ -0,0 +1,95 @@
+package redisc
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/redisc/redistest"
+	"github.com/segmentio/redisc/redistest/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryConnContextCancelDuringTryAgain(t *testing.T) {
+	var s *redistest.MockServer
+	var tryagain int32
+
+	s = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			addr, port, _ := net.SplitHostPort(s.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		case "GET":
+			// always reply TRYAGAIN, simulating a resharding that never
+			// resolves within the test's timeframe.
+			atomic.AddInt32(&tryagain, 1)
+			return resp.Error("TRYAGAIN")
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s.Close()
+
+	c := &Cluster{StartupNodes: []string{s.Addr}}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	conn := c.Get()
+	defer conn.Close()
+
+	rc, err := RetryConnContext(conn, 100, time.Hour)
+	require.NoError(t, err, "RetryConnContext")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = rc.DoContext(ctx, "GET", "x")
+	elapsed := time.Since(start)
+
+	assert.Equal(t, context.Canceled, err, "expected context.Canceled")
+	assert.Less(t, elapsed, time.Second, "cancellation should interrupt the TRYAGAIN sleep promptly")
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&tryagain), int32(1), "at least one attempt was made")
+}
+
+func TestConnDoContextDeadlineExceeded(t *testing.T) {
+	var s *redistest.MockServer
+
+	s = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			addr, port, _ := net.SplitHostPort(s.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		case "GET":
+			time.Sleep(50 * time.Millisecond)
+			return "ok"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s.Close()
+
+	c := &Cluster{StartupNodes: []string{s.Addr}}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	conn := c.Get()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+
+	_, err := conn.(*Conn).DoContext(ctx, "GET", "x")
+	assert.Error(t, err, "expected a timeout error")
+}
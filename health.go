@@ -0,0 +1,246 @@
+package redisc
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// ewmaAlpha is the smoothing factor applied to each new latency sample
+// when updating a node's round-trip time estimate.
+const ewmaAlpha = 0.2
+
+// healthBackoff is the delay before a node marked unhealthy is
+// considered for re-probing. It's a var, rather than a const, so tests
+// can shrink it.
+var healthBackoff = 5 * time.Second
+
+// healthCheckInterval is how often the background health-check loop
+// scans for unhealthy nodes whose backoff has elapsed and re-probes
+// them.
+var healthCheckInterval = time.Second
+
+// nodeHealth tracks the latency estimate and health state of a single
+// cluster node, used by Cluster.ReadPreference's RouteByLatency mode and
+// by replica demotion on connection errors.
+type nodeHealth struct {
+	mu             sync.Mutex
+	latency        time.Duration
+	healthy        bool
+	unhealthyUntil time.Time
+}
+
+func (c *Cluster) nodeState(addr string) *nodeHealth {
+	c.mu.Lock()
+	if c.health == nil {
+		c.health = make(map[string]*nodeHealth)
+	}
+	h, ok := c.health[addr]
+	if !ok {
+		h = &nodeHealth{healthy: true}
+		c.health[addr] = h
+	}
+	c.mu.Unlock()
+	return h
+}
+
+// recordLatency updates addr's latency estimate and health state based on
+// the outcome of a command that just completed against it, demoting the
+// node if err looks like a connection-level failure rather than a normal
+// redis error reply. Any successful command lifts a demotion. A demotion
+// also starts the background health-check loop, which re-probes the node
+// once its backoff has elapsed.
+func (c *Cluster) recordLatency(addr string, d time.Duration, err error) {
+	if addr == "" {
+		return
+	}
+	h := c.nodeState(addr)
+
+	if isConnError(err) {
+		h.mu.Lock()
+		h.healthy = false
+		h.unhealthyUntil = time.Now().Add(healthBackoff)
+		h.mu.Unlock()
+		c.ensureHealthCheckLoop()
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.latency == 0 {
+		h.latency = d
+	} else {
+		h.latency = time.Duration(float64(h.latency)*(1-ewmaAlpha) + float64(d)*ewmaAlpha)
+	}
+	h.healthy = true
+}
+
+// isHealthy reports whether addr is currently considered healthy. A
+// demoted node stays unhealthy until a command recorded against it
+// succeeds, such as the background health-check loop's re-probe once its
+// backoff has elapsed.
+func (c *Cluster) isHealthy(addr string) bool {
+	h := c.nodeState(addr)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy
+}
+
+// ensureHealthCheckLoop starts the background goroutine that re-probes
+// demoted nodes once their backoff has elapsed, the first time a node is
+// demoted.
+func (c *Cluster) ensureHealthCheckLoop() {
+	c.healthOnce.Do(func() {
+		c.mu.Lock()
+		c.healthCloseCh = make(chan struct{})
+		closeCh := c.healthCloseCh
+		c.mu.Unlock()
+		go c.healthCheckLoop(closeCh)
+	})
+}
+
+// healthCheckLoop periodically re-probes nodes that are due (their
+// backoff has elapsed) until closeCh is closed by Cluster.Close.
+func (c *Cluster) healthCheckLoop(closeCh chan struct{}) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			c.probeUnhealthyNodes()
+		}
+	}
+}
+
+// probeUnhealthyNodes re-probes every known node that is currently
+// unhealthy and whose backoff has elapsed.
+func (c *Cluster) probeUnhealthyNodes() {
+	c.mu.Lock()
+	now := time.Now()
+	var due []string
+	for addr, h := range c.health {
+		h.mu.Lock()
+		if !h.healthy && !now.Before(h.unhealthyUntil) {
+			due = append(due, addr)
+		}
+		h.mu.Unlock()
+	}
+	c.mu.Unlock()
+
+	for _, addr := range due {
+		c.probeNode(addr)
+	}
+}
+
+// probeNode sends a PING to addr and records the outcome exactly like a
+// normal command would, lifting the node's demotion on success or
+// restarting its backoff on failure.
+func (c *Cluster) probeNode(addr string) {
+	conn, err := c.getConnForAddr(addr, false)
+	if err != nil {
+		c.recordLatency(addr, 0, err)
+		return
+	}
+	start := time.Now()
+	_, err = conn.Do("PING")
+	c.recordLatency(addr, time.Since(start), err)
+	conn.Close()
+}
+
+func (c *Cluster) latencyOf(addr string) time.Duration {
+	h := c.nodeState(addr)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.latency
+}
+
+// isConnError reports whether err indicates a connection-level failure
+// (dial/read/write/timeout) as opposed to a normal redis error reply such
+// as a redirection or a TRYAGAIN, which don't reflect on the node's
+// health.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, isRedisErr := err.(redis.Error)
+	return !isRedisErr
+}
+
+// pickReadAddr returns the address a read-only command for slot should be
+// sent to, according to pref, among the slot's primary (addrs[0]) and
+// replicas (addrs[1:]). It always falls back to the primary if no
+// replica is healthy.
+func (c *Cluster) pickReadAddr(slot int, pref ReadPreference) string {
+	c.mu.Lock()
+	addrs := append([]string(nil), c.mapping[slot]...)
+	c.mu.Unlock()
+
+	if len(addrs) == 0 {
+		return ""
+	}
+	primary := addrs[0]
+	replicas := addrs[1:]
+
+	switch pref {
+	case PreferReplica:
+		for _, a := range replicas {
+			if c.isHealthy(a) {
+				return a
+			}
+		}
+		return primary
+
+	case RouteRandomly:
+		healthy := c.healthyOf(addrs)
+		if len(healthy) == 0 {
+			return primary
+		}
+		return healthy[rand.Intn(len(healthy))]
+
+	case RouteByLatency:
+		// A healthy node with no latency estimate yet takes priority, so
+		// every node gets a chance to be probed; once all of them have an
+		// estimate, the lowest one wins.
+		unprobed := ""
+		best := ""
+		var bestLatency time.Duration
+		for _, a := range addrs {
+			if !c.isHealthy(a) {
+				continue
+			}
+			l := c.latencyOf(a)
+			if l == 0 {
+				unprobed = a
+				continue
+			}
+			if best == "" || l < bestLatency {
+				best = a
+				bestLatency = l
+			}
+		}
+		if unprobed != "" {
+			return unprobed
+		}
+		if best == "" {
+			return primary
+		}
+		return best
+
+	default: // PrimaryOnly
+		return primary
+	}
+}
+
+func (c *Cluster) healthyOf(addrs []string) []string {
+	var out []string
+	for _, a := range addrs {
+		if c.isHealthy(a) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
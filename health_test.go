@@ -0,0 +1,75 @@
+package redisc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/segmentio/redisc/redistest"
+	"github.com/segmentio/redisc/redistest/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordLatencyDemotesOnConnError(t *testing.T) {
+	c := &Cluster{}
+	defer c.Close()
+
+	const addr = "127.0.0.1:1"
+	assert.True(t, c.isHealthy(addr), "a node with no history yet is considered healthy")
+
+	c.recordLatency(addr, 0, errors.New("dial tcp: connection refused"))
+	assert.False(t, c.isHealthy(addr), "a connection-level error should demote the node")
+
+	c.recordLatency(addr, 2*time.Millisecond, nil)
+	assert.True(t, c.isHealthy(addr), "a successful command should clear the demotion")
+	assert.Equal(t, 2*time.Millisecond, c.latencyOf(addr), "latency")
+}
+
+func TestRecordLatencyIgnoresRedisErrorReplies(t *testing.T) {
+	c := &Cluster{}
+	defer c.Close()
+
+	const addr = "127.0.0.1:1"
+	c.recordLatency(addr, 3*time.Millisecond, redis.Error("TRYAGAIN"))
+	assert.True(t, c.isHealthy(addr), "a normal redis error reply shouldn't demote the node")
+}
+
+func TestRecordLatencyEWMA(t *testing.T) {
+	c := &Cluster{}
+	defer c.Close()
+
+	const addr = "127.0.0.1:1"
+	c.recordLatency(addr, 10*time.Millisecond, nil)
+	assert.Equal(t, 10*time.Millisecond, c.latencyOf(addr), "first sample sets the estimate outright")
+
+	c.recordLatency(addr, 20*time.Millisecond, nil)
+	want := time.Duration(float64(10*time.Millisecond)*(1-ewmaAlpha) + float64(20*time.Millisecond)*ewmaAlpha)
+	assert.Equal(t, want, c.latencyOf(addr), "subsequent samples are blended in with ewmaAlpha")
+}
+
+func TestHealthCheckLoopReprobesAfterBackoff(t *testing.T) {
+	origBackoff, origInterval := healthBackoff, healthCheckInterval
+	healthBackoff = 20 * time.Millisecond
+	healthCheckInterval = 5 * time.Millisecond
+	defer func() { healthBackoff, healthCheckInterval = origBackoff, origInterval }()
+
+	s := redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		if cmd == "PING" {
+			return "PONG"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s.Close()
+
+	c := &Cluster{}
+	defer c.Close()
+
+	c.recordLatency(s.Addr, 0, errors.New("dial tcp: connection refused"))
+	require.False(t, c.isHealthy(s.Addr), "demoted node should start out unhealthy")
+
+	require.Eventually(t, func() bool {
+		return c.isHealthy(s.Addr)
+	}, time.Second, 5*time.Millisecond, "background health check should re-probe and clear the demotion")
+}
@@ -0,0 +1,192 @@
+package redisc
+
+import (
+	"fmt"
+	"sync"
+)
+
+// DefaultPipelineMaxRounds is the default number of dispatch rounds, the
+// initial one included (see Cluster.PipelineWithMaxRounds), a Pipeline
+// will run before giving up on a command that is still being redirected.
+const DefaultPipelineMaxRounds = 5
+
+// Cmd is a single command to execute as part of a Pipeline, in the same
+// shape as the arguments to redis.Conn's Do/Send: Name is the command
+// name and Args its arguments, the first of which is assumed to be the
+// command's key for the purpose of slot routing.
+type Cmd struct {
+	Name string
+	Args []interface{}
+}
+
+// Reply holds the outcome of a single command executed via
+// Cluster.Pipeline. Err is set if that particular command failed,
+// without affecting the other commands in the same batch.
+type Reply struct {
+	Value interface{}
+	Err   error
+}
+
+// Pipeline accumulates a batch of commands, in the same spirit as
+// redigo's Conn.Send/Flush, to be dispatched together with Exec instead
+// of one round-trip per command.
+type Pipeline struct {
+	cluster *Cluster
+	cmds    []Cmd
+}
+
+// NewPipeline creates a Pipeline bound to c.
+func (c *Cluster) NewPipeline() *Pipeline {
+	return &Pipeline{cluster: c}
+}
+
+// Send queues cmd for execution on the next call to Exec.
+func (p *Pipeline) Send(cmd string, args ...interface{}) {
+	p.cmds = append(p.cmds, Cmd{Name: cmd, Args: args})
+}
+
+// Exec dispatches the queued commands via Cluster.Pipeline and resets the
+// Pipeline so it can be reused for a new batch.
+func (p *Pipeline) Exec() ([]Reply, error) {
+	cmds := p.cmds
+	p.cmds = nil
+	return p.cluster.Pipeline(cmds)
+}
+
+// Pipeline dispatches cmds across the cluster in as few network
+// round-trips as possible: commands are grouped by the hash slot of their
+// key (cmd.Args[0]) and one pipeline of commands is sent per target node,
+// reusing the same pooled connections as Conn. Redirections (MOVED, ASK)
+// are resolved and retried on a per-command basis, for up to
+// DefaultPipelineMaxRounds rounds in all (the initial dispatch included,
+// so at most DefaultPipelineMaxRounds-1 redirections are followed per
+// command); a command still being redirected past
+// that point gets a Reply.Err instead of failing the whole batch. The
+// returned slice has the same length and order as cmds.
+func (c *Cluster) Pipeline(cmds []Cmd) ([]Reply, error) {
+	return c.PipelineWithMaxRounds(cmds, DefaultPipelineMaxRounds)
+}
+
+// PipelineWithMaxRounds behaves like Pipeline, but allows the number of
+// dispatch rounds, the initial one included, to be customized.
+func (c *Cluster) PipelineWithMaxRounds(cmds []Cmd, maxRounds int) ([]Reply, error) {
+	replies := make([]Reply, len(cmds))
+
+	pending := make([]pendingCmd, len(cmds))
+	for i, cmd := range cmds {
+		pending[i] = pendingCmd{index: i, cmd: cmd, addr: c.addrForCmd(cmd)}
+	}
+
+	for round := 0; round < maxRounds && len(pending) > 0; round++ {
+		pending = c.pipelineRound(pending, replies)
+	}
+
+	for _, pc := range pending {
+		replies[pc.index] = Reply{Err: fmt.Errorf("redisc: command %q redirected too many times", pc.cmd.Name)}
+	}
+
+	return replies, nil
+}
+
+// pendingCmd tracks a command still awaiting a final reply, keeping its
+// original index so replies can be reassembled in caller order across
+// redirection rounds.
+type pendingCmd struct {
+	index  int
+	cmd    Cmd
+	addr   string
+	asking bool
+}
+
+// pipelineRound groups pending commands by target node, dispatches one
+// pipeline per node concurrently, and returns the commands that must be
+// retried in the next round because of a MOVED or ASK redirection.
+func (c *Cluster) pipelineRound(pending []pendingCmd, replies []Reply) []pendingCmd {
+	byAddr := make(map[string][]pendingCmd)
+	for _, pc := range pending {
+		byAddr[pc.addr] = append(byAddr[pc.addr], pc)
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		next []pendingCmd
+	)
+	for addr, pcs := range byAddr {
+		addr, pcs := addr, pcs
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retry := c.pipelineNode(addr, pcs, replies)
+			mu.Lock()
+			next = append(next, retry...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return next
+}
+
+// pipelineNode issues a single Send/Flush/Receive pipeline for pcs
+// against addr, filling replies for commands that complete and returning
+// the subset that must be retried against a new address in the next
+// round.
+func (c *Cluster) pipelineNode(addr string, pcs []pendingCmd, replies []Reply) []pendingCmd {
+	conn, err := c.getConnForAddr(addr, false)
+	if err != nil {
+		for _, pc := range pcs {
+			replies[pc.index] = Reply{Err: err}
+		}
+		return nil
+	}
+	defer conn.Close()
+
+	for _, pc := range pcs {
+		if pc.asking {
+			conn.Send("ASKING")
+		}
+		conn.Send(pc.cmd.Name, pc.cmd.Args...)
+	}
+	if err := conn.Flush(); err != nil {
+		for _, pc := range pcs {
+			replies[pc.index] = Reply{Err: err}
+		}
+		return nil
+	}
+
+	var retry []pendingCmd
+	for _, pc := range pcs {
+		if pc.asking {
+			conn.Receive() // discard the ASKING reply
+		}
+
+		v, err := conn.Receive()
+		if re := ParseRedir(err); re != nil {
+			if re.Type == "MOVED" {
+				c.setAddrForSlot(re.Slot, re.Addr)
+			}
+			retry = append(retry, pendingCmd{index: pc.index, cmd: pc.cmd, addr: re.Addr, asking: re.Type == "ASK"})
+			continue
+		}
+
+		replies[pc.index] = Reply{Value: v, Err: err}
+	}
+	return retry
+}
+
+// addrForCmd returns the target node address for cmd, based on the hash
+// slot of its key (cmd.Args[0]).
+func (c *Cluster) addrForCmd(cmd Cmd) string {
+	var slot int
+	if len(cmd.Args) > 0 {
+		if key, ok := cmd.Args[0].(string); ok {
+			slot = keyHashSlot(key)
+		}
+	}
+	addr := c.addrForSlot(slot)
+	if addr == "" {
+		addr = c.randomAddr()
+	}
+	return addr
+}
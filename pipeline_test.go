@@ -0,0 +1,115 @@
+package redisc
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/segmentio/redisc/redistest"
+	"github.com/segmentio/redisc/redistest/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterPipelineMixedRedirects(t *testing.T) {
+	var s1, s2 *redistest.MockServer
+	var asking int32
+
+	// s1 claims all slots, but redirects the "moved" key with MOVED to
+	// s2 (simulating a slot that was reassigned to s2) and the "ask"
+	// key with ASK to s2 (simulating a key being migrated to s2).
+	s1 = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			addr, port, _ := net.SplitHostPort(s1.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		case "GET":
+			switch args[0] {
+			case "ok":
+				return "ok-value"
+			case "moved":
+				return resp.Error("MOVED " + strconv.Itoa(keyHashSlot("moved")) + " " + s2.Addr)
+			case "ask":
+				return resp.Error("ASK " + strconv.Itoa(keyHashSlot("ask")) + " " + s2.Addr)
+			}
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s1.Close()
+
+	s2 = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "GET":
+			switch args[0] {
+			case "moved":
+				return "moved-value"
+			case "ask":
+				return "ask-value"
+			}
+		case "ASKING":
+			atomic.AddInt32(&asking, 1)
+			return nil
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s2.Close()
+
+	c := &Cluster{StartupNodes: []string{s1.Addr}}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	replies, err := c.Pipeline([]Cmd{
+		{Name: "GET", Args: []interface{}{"ok"}},
+		{Name: "GET", Args: []interface{}{"moved"}},
+		{Name: "GET", Args: []interface{}{"ask"}},
+	})
+	require.NoError(t, err, "Pipeline")
+	require.Len(t, replies, 3, "replies")
+
+	if assert.NoError(t, replies[0].Err, "ok reply") {
+		assert.Equal(t, []byte("ok-value"), replies[0].Value)
+	}
+	if assert.NoError(t, replies[1].Err, "moved reply") {
+		assert.Equal(t, []byte("moved-value"), replies[1].Value)
+	}
+	if assert.NoError(t, replies[2].Err, "ask reply") {
+		assert.Equal(t, []byte("ask-value"), replies[2].Value)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&asking), "ASKING sent once")
+}
+
+func TestClusterPipelineTooManyRedirects(t *testing.T) {
+	var s *redistest.MockServer
+
+	s = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			addr, port, _ := net.SplitHostPort(s.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		case "GET":
+			// always bounce back to itself with MOVED, simulating a
+			// redirection storm that never resolves.
+			return resp.Error("MOVED " + strconv.Itoa(keyHashSlot(args[0])) + " " + s.Addr)
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s.Close()
+
+	c := &Cluster{StartupNodes: []string{s.Addr}}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	replies, err := c.PipelineWithMaxRounds([]Cmd{{Name: "GET", Args: []interface{}{"x"}}}, 2)
+	require.NoError(t, err, "Pipeline")
+	require.Len(t, replies, 1, "replies")
+	if assert.Error(t, replies[0].Err, "redirected too many times") {
+		assert.Contains(t, replies[0].Err.Error(), "redirected too many times")
+	}
+}
@@ -0,0 +1,412 @@
+package redisc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// maxShardRedirects bounds the number of attempts, the first one
+// included, that SSubscribe and SPublish make for a single channel while
+// following MOVED redirections before giving up.
+const maxShardRedirects = 5
+
+// ShardMessage is a message received on a channel subscribed to via
+// SSubscribe (Redis 7's sharded pub/sub, SSUBSCRIBE/SPUBLISH/SMESSAGE).
+type ShardMessage struct {
+	Channel string
+	Data    []byte
+}
+
+// shardSub is the connection backing the sharded subscriptions held
+// against a single cluster node.
+type shardSub struct {
+	conn     redis.Conn
+	channels map[string]bool
+
+	mu      sync.Mutex
+	pending chan subAck // set while a subscribe/unsubscribe reply is awaited
+	closing bool        // set before a voluntary Close, to silence pumpShard's error
+}
+
+// subAck is delivered to a pending SSUBSCRIBE/SUNSUBSCRIBE call by the
+// shard's pump goroutine, either with nil (success) or a redirection/other
+// error straight from the server.
+type subAck struct {
+	err error
+}
+
+// PubSubConn is a cluster-aware wrapper around redigo's redis.PubSubConn.
+// Subscribe and PSubscribe behave like a single-node PubSubConn, since
+// regular pub/sub messages are broadcast to every node in the cluster;
+// SSubscribe and SPublish, on the other hand, route to the node owning
+// the channel's hash slot, dialing one additional connection per target
+// node. Messages from all of these connections - regular and sharded -
+// are multiplexed onto a single stream, read with Receive.
+//
+// A PubSubConn must not be used concurrently from multiple goroutines,
+// except for Close and Receive, which may be called from a different
+// goroutine than the one issuing Subscribe/SSubscribe/etc.
+type PubSubConn struct {
+	cluster *Cluster
+
+	mu      sync.Mutex
+	regular *redis.PubSubConn
+	shards  map[string]*shardSub
+	closed  bool
+
+	msgs chan interface{}
+}
+
+// PubSub creates a PubSubConn bound to c.
+func (c *Cluster) PubSub() *PubSubConn {
+	return &PubSubConn{
+		cluster: c,
+		shards:  make(map[string]*shardSub),
+		msgs:    make(chan interface{}, 64),
+	}
+}
+
+// Subscribe subscribes the connection to the given channels, as
+// redis.PubSubConn.Subscribe. The underlying connection is dialed to an
+// arbitrary cluster node on first use, since regular subscriptions are
+// visible cluster-wide.
+func (p *PubSubConn) Subscribe(channel ...interface{}) error {
+	if err := p.ensureRegular(); err != nil {
+		return err
+	}
+	return p.regular.Subscribe(channel...)
+}
+
+// PSubscribe subscribes the connection to the given patterns, as
+// redis.PubSubConn.PSubscribe.
+func (p *PubSubConn) PSubscribe(pattern ...interface{}) error {
+	if err := p.ensureRegular(); err != nil {
+		return err
+	}
+	return p.regular.PSubscribe(pattern...)
+}
+
+// Unsubscribe unsubscribes the connection from the given channels, as
+// redis.PubSubConn.Unsubscribe.
+func (p *PubSubConn) Unsubscribe(channel ...interface{}) error {
+	if p.regular == nil {
+		return nil
+	}
+	return p.regular.Unsubscribe(channel...)
+}
+
+// PUnsubscribe unsubscribes the connection from the given patterns, as
+// redis.PubSubConn.PUnsubscribe.
+func (p *PubSubConn) PUnsubscribe(pattern ...interface{}) error {
+	if p.regular == nil {
+		return nil
+	}
+	return p.regular.PUnsubscribe(pattern...)
+}
+
+// SSubscribe subscribes to the given sharded channels (SSUBSCRIBE),
+// opening a connection to the primary owning each channel's hash slot. If
+// the owning node reports that the slot has moved, the subscription is
+// transparently retried against the new owner.
+func (p *PubSubConn) SSubscribe(channels ...string) error {
+	for _, ch := range channels {
+		if err := p.sSubscribeOne(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SUnsubscribe unsubscribes from the given sharded channels (SUNSUBSCRIBE).
+func (p *PubSubConn) SUnsubscribe(channels ...string) error {
+	for _, ch := range channels {
+		if err := p.sUnsubscribeOne(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SPublish publishes message to the given sharded channel (SPUBLISH),
+// routed to the primary owning the channel's hash slot, following a MOVED
+// redirection if the slot has since moved.
+func (p *PubSubConn) SPublish(channel string, message interface{}) (int, error) {
+	slot := keyHashSlot(channel)
+	addr := p.addrForSlot(slot)
+	if addr == "" {
+		return 0, errors.New("redisc: no node known for channel's slot")
+	}
+
+	for attempt := 0; attempt < maxShardRedirects; attempt++ {
+		conn, err := p.cluster.getConnForAddr(addr, false)
+		if err != nil {
+			return 0, err
+		}
+		n, err := redis.Int(conn.Do("SPUBLISH", channel, message))
+		conn.Close()
+
+		if re := ParseRedir(err); re != nil && re.Type == "MOVED" {
+			p.cluster.setAddrForSlot(re.Slot, re.Addr)
+			addr = re.Addr
+			continue
+		}
+		return n, err
+	}
+	return 0, fmt.Errorf("redisc: SPUBLISH to %q redirected too many times", channel)
+}
+
+// Receive returns the next message from any of the connections (regular
+// or sharded) backing this PubSubConn: a redis.Message, redis.PMessage,
+// *ShardMessage, redis.Subscription, or an error if a connection broke.
+func (p *PubSubConn) Receive() interface{} {
+	return <-p.msgs
+}
+
+// Close closes all of the connections backing this PubSubConn.
+func (p *PubSubConn) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	var err error
+	if p.regular != nil {
+		if cerr := p.regular.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	for _, sub := range p.shards {
+		if cerr := sub.conn.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (p *PubSubConn) addrForSlot(slot int) string {
+	addr := p.cluster.addrForSlot(slot)
+	if addr == "" {
+		addr = p.cluster.randomAddr()
+	}
+	return addr
+}
+
+func (p *PubSubConn) ensureRegular() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.regular != nil {
+		return nil
+	}
+
+	addr := p.cluster.randomAddr()
+	if addr == "" {
+		return errors.New("redisc: no node known, call Cluster.Refresh first")
+	}
+	rc, err := redis.Dial("tcp", addr, p.cluster.DialOptions...)
+	if err != nil {
+		return err
+	}
+	p.regular = &redis.PubSubConn{Conn: rc}
+	go p.pumpRegular()
+	return nil
+}
+
+func (p *PubSubConn) pumpRegular() {
+	for {
+		v := p.regular.Receive()
+		p.msgs <- v
+		if _, ok := v.(error); ok {
+			return
+		}
+	}
+}
+
+// shardFor returns the shardSub connected to addr, dialing it (and
+// starting its pump goroutine) on first use.
+func (p *PubSubConn) shardFor(addr string) (*shardSub, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if sub, ok := p.shards[addr]; ok {
+		return sub, nil
+	}
+
+	rc, err := redis.Dial("tcp", addr, p.cluster.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	sub := &shardSub{conn: rc, channels: make(map[string]bool)}
+	p.shards[addr] = sub
+	go p.pumpShard(addr, sub)
+	return sub, nil
+}
+
+// pumpShard reads every reply from sub's connection: sharded messages and
+// subscribe/unsubscribe confirmations are forwarded to p.msgs, except a
+// confirmation (or error) that a doOnShard call is waiting for, which is
+// instead delivered on sub.pending.
+func (p *PubSubConn) pumpShard(addr string, sub *shardSub) {
+	for {
+		reply, err := sub.conn.Receive()
+		if err != nil {
+			if p.deliverPending(sub, err) {
+				continue
+			}
+
+			p.mu.Lock()
+			delete(p.shards, addr)
+			p.mu.Unlock()
+
+			sub.mu.Lock()
+			closing := sub.closing
+			sub.mu.Unlock()
+			if !closing {
+				p.msgs <- err
+			}
+			return
+		}
+
+		values, verr := redis.Values(reply, nil)
+		if verr != nil || len(values) < 2 {
+			continue
+		}
+		kind, _ := redis.String(values[0], nil)
+
+		switch kind {
+		case "smessage":
+			if len(values) < 3 {
+				continue
+			}
+			channel, _ := redis.String(values[1], nil)
+			data, _ := redis.Bytes(values[2], nil)
+			p.msgs <- &ShardMessage{Channel: channel, Data: data}
+
+		case "ssubscribe", "sunsubscribe":
+			channel, _ := redis.String(values[1], nil)
+			count, _ := redis.Int(values[2], nil)
+			if !p.deliverPending(sub, nil) {
+				p.msgs <- redis.Subscription{Kind: kind, Channel: channel, Count: count}
+			}
+		}
+	}
+}
+
+// deliverPending hands err (nil for success) to the doOnShard call
+// currently waiting on sub.pending, if any, and reports whether there was
+// one.
+func (p *PubSubConn) deliverPending(sub *shardSub, err error) bool {
+	sub.mu.Lock()
+	pending := sub.pending
+	sub.pending = nil
+	sub.mu.Unlock()
+
+	if pending == nil {
+		return false
+	}
+	pending <- subAck{err: err}
+	return true
+}
+
+// doOnShard sends command+channel to sub and blocks until its reply (or
+// an error on the connection) is delivered by the pump goroutine.
+func (p *PubSubConn) doOnShard(sub *shardSub, command, channel string) error {
+	ack := make(chan subAck, 1)
+
+	sub.mu.Lock()
+	sub.pending = ack
+	sendErr := sub.conn.Send(command, channel)
+	if sendErr == nil {
+		sendErr = sub.conn.Flush()
+	}
+	sub.mu.Unlock()
+
+	if sendErr != nil {
+		return sendErr
+	}
+
+	res := <-ack
+	return res.err
+}
+
+func (p *PubSubConn) sSubscribeOne(channel string) error {
+	addr := p.addrForSlot(keyHashSlot(channel))
+	if addr == "" {
+		return errors.New("redisc: no node known for channel's slot")
+	}
+
+	for attempt := 0; attempt < maxShardRedirects; attempt++ {
+		sub, err := p.shardFor(addr)
+		if err != nil {
+			return err
+		}
+
+		err = p.doOnShard(sub, "SSUBSCRIBE", channel)
+		if re := ParseRedir(err); re != nil && re.Type == "MOVED" {
+			if sub.channels[channel] {
+				// channel was subscribed here before the slot moved;
+				// forget it on the old node now that it's being
+				// resubscribed against the new owner.
+				p.forgetShardChannel(addr, sub, channel)
+			}
+			p.cluster.setAddrForSlot(re.Slot, re.Addr)
+			addr = re.Addr
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		sub.channels[channel] = true
+		return nil
+	}
+	return fmt.Errorf("redisc: subscribe to %q redirected too many times", channel)
+}
+
+func (p *PubSubConn) sUnsubscribeOne(channel string) error {
+	p.mu.Lock()
+	var targetAddr string
+	var target *shardSub
+	for addr, sub := range p.shards {
+		if sub.channels[channel] {
+			targetAddr = addr
+			target = sub
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if target == nil {
+		return nil
+	}
+	if err := p.doOnShard(target, "SUNSUBSCRIBE", channel); err != nil {
+		return err
+	}
+	p.forgetShardChannel(targetAddr, target, channel)
+	return nil
+}
+
+// forgetShardChannel removes channel from sub's set of subscriptions, and,
+// if that was its last one, closes sub's connection and discards it from
+// p.shards so a later SSubscribe for addr dials a fresh one
+// instead of reusing an idle or stale connection.
+func (p *PubSubConn) forgetShardChannel(addr string, sub *shardSub, channel string) {
+	delete(sub.channels, channel)
+	if len(sub.channels) > 0 {
+		return
+	}
+	p.mu.Lock()
+	if p.shards[addr] == sub {
+		delete(p.shards, addr)
+	}
+	p.mu.Unlock()
+
+	sub.mu.Lock()
+	sub.closing = true
+	sub.mu.Unlock()
+	sub.conn.Close()
+}
@@ -0,0 +1,106 @@
+package redisc
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/segmentio/redisc/redistest"
+	"github.com/segmentio/redisc/redistest/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubSubConnSSubscribeMigration(t *testing.T) {
+	var node1, node2 *redistest.MockServer
+	var moved int32
+	var node2Subscribed int32
+
+	node1 = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			addr, port, _ := net.SplitHostPort(node1.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		case "SSUBSCRIBE":
+			if atomic.LoadInt32(&moved) == 1 {
+				return resp.Error("MOVED " + strconv.Itoa(keyHashSlot(args[0])) + " " + node2.Addr)
+			}
+			return resp.Array{0: "ssubscribe", 1: args[0], 2: int64(1)}
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer node1.Close()
+
+	node2 = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "SSUBSCRIBE":
+			atomic.AddInt32(&node2Subscribed, 1)
+			return resp.Array{0: "ssubscribe", 1: args[0], 2: int64(1)}
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer node2.Close()
+
+	c := &Cluster{StartupNodes: []string{node1.Addr}}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	ps := c.PubSub()
+	defer ps.Close()
+
+	require.NoError(t, ps.SSubscribe("channel"), "initial SSubscribe")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&node2Subscribed), "not yet migrated")
+
+	// simulate the slot for "channel" being resharded onto node2
+	atomic.StoreInt32(&moved, 1)
+
+	require.NoError(t, ps.SSubscribe("channel"), "SSubscribe after migration")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&node2Subscribed), "migrated to node2")
+
+	c.mu.Lock()
+	addr := c.mapping[keyHashSlot("channel")][0]
+	c.mu.Unlock()
+	assert.Equal(t, node2.Addr, addr, "cluster mapping updated to node2")
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	assert.Len(t, ps.shards, 1, "the stale shard connection to node1 should have been discarded")
+	if sub, ok := ps.shards[node1.Addr]; ok {
+		assert.False(t, sub.channels["channel"], "node1 shouldn't still think it's subscribed to channel")
+	}
+}
+
+func TestPubSubConnSPublish(t *testing.T) {
+	var s *redistest.MockServer
+
+	s = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			addr, port, _ := net.SplitHostPort(s.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		case "SPUBLISH":
+			return int64(1)
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s.Close()
+
+	c := &Cluster{StartupNodes: []string{s.Addr}}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	ps := c.PubSub()
+	defer ps.Close()
+
+	n, err := ps.SPublish("channel", "hello")
+	if assert.NoError(t, err, "SPublish") {
+		assert.Equal(t, 1, n)
+	}
+}
@@ -0,0 +1,51 @@
+package redisc
+
+// ReadPreference controls how a Conn picks the node to dispatch read-only
+// commands to, once it has been marked read-only with Conn.ReadOnly.
+// Write commands (and read commands on a Conn that hasn't called
+// ReadOnly) bind a Conn to the slot's primary. A Conn keeps the node it
+// first bound to, so a write issued after a read has bound the Conn to a
+// replica is sent to that replica.
+type ReadPreference int
+
+const (
+	// PrimaryOnly always dispatches commands to the slot's primary. This
+	// is the default behavior.
+	PrimaryOnly ReadPreference = iota
+
+	// PreferReplica dispatches read-only commands to one of the slot's
+	// replicas, chosen arbitrarily among the healthy ones, falling back
+	// to the primary if none are healthy.
+	PreferReplica
+
+	// RouteRandomly dispatches read-only commands to a uniformly random
+	// healthy node among the slot's primary and replicas.
+	RouteRandomly
+
+	// RouteByLatency dispatches read-only commands to the healthy node
+	// (primary or replica) with the lowest observed EWMA round-trip
+	// latency in the slot's node set. A healthy node with no latency
+	// estimate yet is picked ahead of the others.
+	RouteByLatency
+)
+
+// IsReadCommand reports whether cmd is a read-only command eligible for
+// replica routing, using readCommands by default. It is a variable so
+// that callers can install their own command classifier, e.g. to
+// recognize custom or future read-only commands.
+var IsReadCommand = defaultIsReadCommand
+
+// readCommands lists the command names considered read-only by the
+// default command classifier.
+var readCommands = map[string]bool{
+	"GET": true, "MGET": true, "GETRANGE": true, "STRLEN": true,
+	"HGET": true, "HMGET": true, "HGETALL": true, "HKEYS": true, "HVALS": true, "HLEN": true, "HEXISTS": true, "HSTRLEN": true,
+	"LRANGE": true, "LLEN": true, "LINDEX": true,
+	"SMEMBERS": true, "SISMEMBER": true, "SCARD": true, "SRANDMEMBER": true, "SUNION": true, "SINTER": true, "SDIFF": true,
+	"ZRANGE": true, "ZREVRANGE": true, "ZRANGEBYSCORE": true, "ZREVRANGEBYSCORE": true, "ZSCORE": true, "ZCARD": true, "ZRANK": true, "ZREVRANK": true,
+	"EXISTS": true, "TTL": true, "PTTL": true, "TYPE": true,
+}
+
+func defaultIsReadCommand(cmd string) bool {
+	return readCommands[cmd]
+}
@@ -0,0 +1,266 @@
+package redisc
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/redisc/redistest"
+	"github.com/segmentio/redisc/redistest/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnReadOnlyPreferReplica(t *testing.T) {
+	var primary, replica *redistest.MockServer
+	var readonlySent bool
+
+	primary = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			pAddr, pPort, _ := net.SplitHostPort(primary.Addr)
+			nPPort, _ := strconv.Atoi(pPort)
+			rAddr, rPort, _ := net.SplitHostPort(replica.Addr)
+			nRPort, _ := strconv.Atoi(rPort)
+			return resp.Array{
+				0: resp.Array{
+					0: int64(0), 1: int64(hashSlots - 1),
+					2: resp.Array{0: pAddr, 1: int64(nPPort)},
+					3: resp.Array{0: rAddr, 1: int64(nRPort)},
+				},
+			}
+		case "GET":
+			return "from-primary"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer primary.Close()
+
+	replica = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "READONLY":
+			readonlySent = true
+			return nil
+		case "GET":
+			return "from-replica"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer replica.Close()
+
+	c := &Cluster{
+		StartupNodes:   []string{primary.Addr},
+		ReadPreference: PreferReplica,
+	}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	conn := c.Get()
+	defer conn.Close()
+	require.NoError(t, conn.(*Conn).ReadOnly(), "ReadOnly")
+
+	v, err := conn.Do("GET", "x")
+	if assert.NoError(t, err, "GET") {
+		assert.Equal(t, []byte("from-replica"), v)
+		assert.True(t, readonlySent, "READONLY sent")
+	}
+}
+
+func TestConnReadOnlyWriteStillGoesToPrimary(t *testing.T) {
+	var primary, replica *redistest.MockServer
+
+	primary = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			pAddr, pPort, _ := net.SplitHostPort(primary.Addr)
+			nPPort, _ := strconv.Atoi(pPort)
+			rAddr, rPort, _ := net.SplitHostPort(replica.Addr)
+			nRPort, _ := strconv.Atoi(rPort)
+			return resp.Array{
+				0: resp.Array{
+					0: int64(0), 1: int64(hashSlots - 1),
+					2: resp.Array{0: pAddr, 1: int64(nPPort)},
+					3: resp.Array{0: rAddr, 1: int64(nRPort)},
+				},
+			}
+		case "SET":
+			return "OK"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer primary.Close()
+
+	replica = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		return resp.Error("unexpected command on replica " + cmd)
+	})
+	defer replica.Close()
+
+	c := &Cluster{
+		StartupNodes:   []string{primary.Addr},
+		ReadPreference: PreferReplica,
+	}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	conn := c.Get()
+	defer conn.Close()
+	require.NoError(t, conn.(*Conn).ReadOnly(), "ReadOnly")
+
+	_, err := conn.Do("SET", "x", "y")
+	assert.NoError(t, err, "SET should still go to the primary")
+}
+
+func TestConnReadOnlyRouteRandomly(t *testing.T) {
+	var primary, replicaA, replicaB *redistest.MockServer
+	var hitsA, hitsB int32
+
+	primary = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			pAddr, pPort, _ := net.SplitHostPort(primary.Addr)
+			nPPort, _ := strconv.Atoi(pPort)
+			aAddr, aPort, _ := net.SplitHostPort(replicaA.Addr)
+			nAPort, _ := strconv.Atoi(aPort)
+			bAddr, bPort, _ := net.SplitHostPort(replicaB.Addr)
+			nBPort, _ := strconv.Atoi(bPort)
+			return resp.Array{
+				0: resp.Array{
+					0: int64(0), 1: int64(hashSlots - 1),
+					2: resp.Array{0: pAddr, 1: int64(nPPort)},
+					3: resp.Array{0: aAddr, 1: int64(nAPort)},
+					4: resp.Array{0: bAddr, 1: int64(nBPort)},
+				},
+			}
+		case "READONLY":
+			return nil
+		case "GET":
+			return "from-primary"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer primary.Close()
+
+	replicaA = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "READONLY":
+			return nil
+		case "GET":
+			atomic.AddInt32(&hitsA, 1)
+			return "from-a"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer replicaA.Close()
+
+	replicaB = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "READONLY":
+			return nil
+		case "GET":
+			atomic.AddInt32(&hitsB, 1)
+			return "from-b"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer replicaB.Close()
+
+	c := &Cluster{
+		StartupNodes:   []string{primary.Addr},
+		ReadPreference: RouteRandomly,
+	}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	for i := 0; i < 50; i++ {
+		conn := c.Get()
+		require.NoError(t, conn.(*Conn).ReadOnly(), "ReadOnly")
+		_, err := conn.Do("GET", "x")
+		assert.NoError(t, err, "GET")
+		conn.Close()
+	}
+
+	assert.True(t, atomic.LoadInt32(&hitsA) > 0, "replica A should have been used at least once")
+	assert.True(t, atomic.LoadInt32(&hitsB) > 0, "replica B should have been used at least once")
+}
+
+func TestConnReadOnlyRouteByLatency(t *testing.T) {
+	var primary, fast, slow *redistest.MockServer
+	var hitsFast, hitsSlow int32
+
+	primary = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			pAddr, pPort, _ := net.SplitHostPort(primary.Addr)
+			nPPort, _ := strconv.Atoi(pPort)
+			fAddr, fPort, _ := net.SplitHostPort(fast.Addr)
+			nFPort, _ := strconv.Atoi(fPort)
+			sAddr, sPort, _ := net.SplitHostPort(slow.Addr)
+			nSPort, _ := strconv.Atoi(sPort)
+			return resp.Array{
+				0: resp.Array{
+					0: int64(0), 1: int64(hashSlots - 1),
+					2: resp.Array{0: pAddr, 1: int64(nPPort)},
+					3: resp.Array{0: fAddr, 1: int64(nFPort)},
+					4: resp.Array{0: sAddr, 1: int64(nSPort)},
+				},
+			}
+		case "READONLY":
+			return nil
+		case "GET":
+			return "from-primary"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer primary.Close()
+
+	fast = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "READONLY":
+			return nil
+		case "GET":
+			atomic.AddInt32(&hitsFast, 1)
+			return "from-fast"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer fast.Close()
+
+	slow = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "READONLY":
+			return nil
+		case "GET":
+			atomic.AddInt32(&hitsSlow, 1)
+			return "from-slow"
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer slow.Close()
+
+	c := &Cluster{
+		StartupNodes:   []string{primary.Addr},
+		ReadPreference: RouteByLatency,
+	}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	// Seed every node's latency estimate directly, so which one
+	// RouteByLatency should prefer is deterministic instead of racing
+	// against real network timing.
+	c.recordLatency(primary.Addr, 5*time.Millisecond, nil)
+	c.recordLatency(fast.Addr, 1*time.Millisecond, nil)
+	c.recordLatency(slow.Addr, 50*time.Millisecond, nil)
+
+	for i := 0; i < 5; i++ {
+		conn := c.Get()
+		require.NoError(t, conn.(*Conn).ReadOnly(), "ReadOnly")
+		_, err := conn.Do("GET", "x")
+		assert.NoError(t, err, "GET")
+		conn.Close()
+	}
+
+	assert.Equal(t, int32(5), atomic.LoadInt32(&hitsFast), "node with the lowest latency estimate should be picked every time")
+	assert.Zero(t, atomic.LoadInt32(&hitsSlow), "the higher-latency node shouldn't be picked")
+}
@@ -0,0 +1,517 @@
+// Package redisc implements a redis cluster client on top of the redigo
+// package (github.com/gomodule/redigo). It manages the mapping of hash
+// slots to cluster nodes, dials pooled connections to those nodes, and
+// exposes a Conn that behaves like a regular redigo connection while
+// transparently following MOVED and ASK redirections when wrapped with
+// RetryConn.
+package redisc
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// hashSlots is the fixed number of hash slots in a redis cluster.
+const hashSlots = 16384
+
+var (
+	// errNoStartupNodes is returned by Refresh when the Cluster has no
+	// StartupNodes to contact.
+	errNoStartupNodes = errors.New("redisc: no startup nodes")
+)
+
+// CreatePoolFunc is the signature for a function that creates a *redis.Pool
+// for a given cluster node address.
+type CreatePoolFunc func(addr string, options ...redis.DialOption) (*redis.Pool, error)
+
+// Cluster manages a connection to a redis cluster. It keeps track of the
+// mapping between hash slots and the nodes that serve them, and creates
+// one connection pool per node as needed. A Cluster must not be copied
+// after first use.
+type Cluster struct {
+	// StartupNodes is the list of initial nodes ("host:port") used to
+	// discover the cluster's topology via Refresh.
+	StartupNodes []string
+
+	// DialOptions is the list of options to use for each new connection,
+	// both for the internal CLUSTER SLOTS calls and for the pools created
+	// via CreatePool.
+	DialOptions []redis.DialOption
+
+	// CreatePool, if set, is used to create the *redis.Pool for a given
+	// node address, instead of the default pool configuration.
+	CreatePool CreatePoolFunc
+
+	// PoolWaitTime, if non-zero, sets Wait: true on the default pool
+	// (the one used when CreatePool is nil). The duration itself does not
+	// bound how long a pool waits for a connection, and a pool returned
+	// by CreatePool is used as configured.
+	PoolWaitTime time.Duration
+
+	// ReadPreference controls how a Conn marked read-only (via
+	// Conn.ReadOnly) picks the node to dispatch a read command to. It
+	// defaults to PrimaryOnly, i.e. replicas are never used unless this
+	// is changed.
+	ReadPreference ReadPreference
+
+	// RefreshInterval, if non-zero, starts a background goroutine (on
+	// the first call to Refresh) that periodically re-runs topology
+	// discovery, so the slot mapping self-heals even without an explicit
+	// Refresh call or a MOVED-triggered refresh. Off by default.
+	RefreshInterval time.Duration
+
+	// MovedThreshold, if non-zero, triggers an automatic full topology
+	// refresh once at least MovedThreshold MOVED redirections have been
+	// observed within MovedWindow, which usually indicates a resharding
+	// in progress. Off by default.
+	MovedThreshold int
+
+	// MovedWindow is the rolling time window used by MovedThreshold.
+	// Defaults to one second if MovedThreshold is set but MovedWindow is
+	// zero.
+	MovedWindow time.Duration
+
+	mu      sync.Mutex
+	pools   map[string]*redis.Pool
+	mapping [hashSlots][]string    // addr of primary at index 0, replicas follow
+	health  map[string]*nodeHealth // latency/health tracking, keyed by node addr
+	stats   Stats
+
+	inFlight      *refreshCall // non-nil while a refresh is in progress, for coalescing
+	bgOnce        sync.Once
+	closeCh       chan struct{} // closed by Close to stop the background refresh loop
+	movedAt       []time.Time   // timestamps of recent MOVED redirections
+	movedMu       sync.Mutex
+	healthOnce    sync.Once
+	healthCloseCh chan struct{} // closed by Close to stop the background health-check loop
+}
+
+// Refresh updates the cluster's slot mapping by calling CLUSTER SHARDS
+// (falling back to CLUSTER SLOTS on older servers) on one of the
+// StartupNodes, or, after the first successful call, on any node already
+// known to the cluster. Concurrent calls to Refresh, as well as ones
+// triggered automatically by RefreshInterval or MovedThreshold, are
+// coalesced: only one topology discovery round runs at a time, and every
+// caller waiting on it receives its result.
+//
+// If RefreshInterval is set, the first call to Refresh also starts the
+// background refresh goroutine, whether or not that call succeeds.
+func (c *Cluster) Refresh() error {
+	err := c.refresh()
+	c.ensureBackgroundRefresh()
+	return err
+}
+
+// refreshCall represents a single in-flight topology discovery round,
+// shared by every caller that asks for a refresh while it is running.
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// refresh performs (or waits for an already in-progress) topology
+// discovery round and records the outcome in Stats.
+func (c *Cluster) refresh() error {
+	if len(c.startupAddrs()) == 0 {
+		return errNoStartupNodes
+	}
+
+	c.mu.Lock()
+	if call := c.inFlight; call != nil {
+		c.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	c.inFlight = call
+	c.mu.Unlock()
+
+	err := c.doRefresh()
+
+	c.mu.Lock()
+	c.inFlight = nil
+	c.stats.LastRefreshTime = time.Now()
+	c.stats.RefreshCount++
+	c.stats.LastRefreshErr = err
+	c.mu.Unlock()
+
+	call.err = err
+	close(call.done)
+	return err
+}
+
+// doRefresh is the actual topology discovery round, tried against each
+// known address in turn until one succeeds.
+func (c *Cluster) doRefresh() error {
+	var lastErr error
+	for _, addr := range c.startupAddrs() {
+		mapping, err := c.getClusterShards(addr)
+		if err != nil {
+			mapping, err = c.getClusterSlots(addr)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		c.mu.Lock()
+		c.mapping = mapping
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("redisc: refresh failed: %v", lastErr)
+}
+
+// ensureBackgroundRefresh starts the periodic refresh goroutine the first
+// time it is called on a Cluster with a non-zero RefreshInterval.
+func (c *Cluster) ensureBackgroundRefresh() {
+	if c.RefreshInterval <= 0 {
+		return
+	}
+	c.bgOnce.Do(func() {
+		c.mu.Lock()
+		c.closeCh = make(chan struct{})
+		closeCh := c.closeCh
+		c.mu.Unlock()
+		go c.backgroundRefreshLoop(closeCh)
+	})
+}
+
+func (c *Cluster) backgroundRefreshLoop(closeCh chan struct{}) {
+	ticker := time.NewTicker(c.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+			c.refresh()
+		}
+	}
+}
+
+// noteMoved records a MOVED redirection for the purpose of
+// MovedThreshold/MovedWindow, triggering an asynchronous full refresh
+// once the threshold is reached within the window.
+func (c *Cluster) noteMoved() {
+	if c.MovedThreshold <= 0 {
+		return
+	}
+	window := c.MovedWindow
+	if window <= 0 {
+		window = time.Second
+	}
+
+	now := time.Now()
+	c.movedMu.Lock()
+	c.movedAt = append(c.movedAt, now)
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(c.movedAt) && c.movedAt[i].Before(cutoff) {
+		i++
+	}
+	c.movedAt = c.movedAt[i:]
+	trigger := len(c.movedAt) >= c.MovedThreshold
+	if trigger {
+		c.movedAt = nil
+	}
+	c.movedMu.Unlock()
+
+	if trigger {
+		go c.refresh()
+	}
+}
+
+// Stats holds refresh observability counters, as returned by
+// Cluster.Stats.
+type Stats struct {
+	// LastRefreshTime is when the last topology refresh (successful or
+	// not) completed.
+	LastRefreshTime time.Time
+	// RefreshCount is the total number of completed refreshes.
+	RefreshCount int
+	// LastRefreshErr is the error returned by the last refresh, or nil.
+	LastRefreshErr error
+}
+
+// Stats returns a snapshot of the cluster's refresh statistics.
+func (c *Cluster) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// startupAddrs returns the set of addresses to try a refresh against:
+// known nodes first (if any), falling back to the configured StartupNodes.
+func (c *Cluster) startupAddrs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, addrs2 := range c.mapping {
+		for _, a := range addrs2 {
+			if a != "" && !seen[a] {
+				seen[a] = true
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs
+	}
+	return c.StartupNodes
+}
+
+// getClusterSlots calls CLUSTER SLOTS against addr and parses the result
+// into a slot mapping.
+func (c *Cluster) getClusterSlots(addr string) ([hashSlots][]string, error) {
+	var mapping [hashSlots][]string
+
+	conn, err := c.getConnForAddr(addr, true)
+	if err != nil {
+		return mapping, err
+	}
+	defer conn.Close()
+
+	res, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return mapping, err
+	}
+
+	for _, raw := range res {
+		slotRange, err := redis.Values(raw, nil)
+		if err != nil {
+			return mapping, err
+		}
+		if len(slotRange) < 3 {
+			continue
+		}
+		start, _ := redis.Int(slotRange[0], nil)
+		end, _ := redis.Int(slotRange[1], nil)
+
+		var addrs []string
+		for _, rawNode := range slotRange[2:] {
+			node, err := redis.Values(rawNode, nil)
+			if err != nil {
+				return mapping, err
+			}
+			if len(node) < 2 {
+				continue
+			}
+			host, _ := redis.String(node[0], nil)
+			port, _ := redis.Int(node[1], nil)
+			addrs = append(addrs, fmt.Sprintf("%s:%d", host, port))
+		}
+
+		for slot := start; slot <= end && slot < hashSlots; slot++ {
+			mapping[slot] = addrs
+		}
+	}
+
+	return mapping, nil
+}
+
+// getClusterShards calls CLUSTER SHARDS against addr (Redis 7+) and
+// parses the result into a slot mapping. CLUSTER SHARDS carries richer
+// topology information than CLUSTER SLOTS (replica roles and health), of
+// which only node addresses and roles (to tell the primary from its
+// replicas) are used.
+func (c *Cluster) getClusterShards(addr string) ([hashSlots][]string, error) {
+	var mapping [hashSlots][]string
+
+	conn, err := c.getConnForAddr(addr, true)
+	if err != nil {
+		return mapping, err
+	}
+	defer conn.Close()
+
+	res, err := redis.Values(conn.Do("CLUSTER", "SHARDS"))
+	if err != nil {
+		return mapping, err
+	}
+
+	var sawSlot bool
+	for _, rawShard := range res {
+		shard, err := redis.Values(rawShard, nil)
+		if err != nil {
+			return mapping, err
+		}
+		fields := fieldMap(shard)
+
+		rawSlots, _ := redis.Values(fields["slots"], nil)
+		slotPairs := make([]int, 0, len(rawSlots))
+		for _, v := range rawSlots {
+			n, _ := redis.Int(v, nil)
+			slotPairs = append(slotPairs, n)
+		}
+
+		rawNodes, _ := redis.Values(fields["nodes"], nil)
+		var primary string
+		var replicas []string
+		for _, rawNode := range rawNodes {
+			nodeVals, err := redis.Values(rawNode, nil)
+			if err != nil {
+				continue
+			}
+			nf := fieldMap(nodeVals)
+			ip, _ := redis.String(nf["ip"], nil)
+			port, _ := redis.Int(nf["port"], nil)
+			role, _ := redis.String(nf["role"], nil)
+			nodeAddr := fmt.Sprintf("%s:%d", ip, port)
+			if role == "master" {
+				primary = nodeAddr
+			} else {
+				replicas = append(replicas, nodeAddr)
+			}
+		}
+		if primary == "" {
+			continue
+		}
+		addrs := append([]string{primary}, replicas...)
+
+		for i := 0; i+1 < len(slotPairs); i += 2 {
+			start, end := slotPairs[i], slotPairs[i+1]
+			for slot := start; slot <= end && slot < hashSlots; slot++ {
+				mapping[slot] = addrs
+				sawSlot = true
+			}
+		}
+	}
+
+	if !sawSlot {
+		return mapping, errors.New("redisc: CLUSTER SHARDS reply did not contain any usable slot assignment")
+	}
+
+	return mapping, nil
+}
+
+// fieldMap turns a RESP flat "key1, value1, key2, value2, ..." reply (as
+// used by CLUSTER SHARDS) into a map for convenient lookup.
+func fieldMap(vals []interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(vals)/2)
+	for i := 0; i+1 < len(vals); i += 2 {
+		key, _ := redis.String(vals[i], nil)
+		m[key] = vals[i+1]
+	}
+	return m
+}
+
+// getConnForAddr returns a connection to addr, either from the pool (and
+// creating the pool first if necessary) or, if forceDial is true, a
+// standalone connection that bypasses the pool entirely (used for the
+// internal CLUSTER SLOTS calls during Refresh, before the pool for that
+// node necessarily exists).
+func (c *Cluster) getConnForAddr(addr string, forceDial bool) (redis.Conn, error) {
+	if forceDial {
+		return redis.Dial("tcp", addr, c.DialOptions...)
+	}
+
+	c.mu.Lock()
+	if c.pools == nil {
+		c.pools = make(map[string]*redis.Pool)
+	}
+	pool, ok := c.pools[addr]
+	if !ok {
+		var err error
+		if c.CreatePool != nil {
+			pool, err = c.CreatePool(addr, c.DialOptions...)
+		} else {
+			pool = &redis.Pool{
+				MaxIdle:     1,
+				Wait:        c.PoolWaitTime > 0,
+				IdleTimeout: 5 * time.Minute,
+				Dial: func() (redis.Conn, error) {
+					return redis.Dial("tcp", addr, c.DialOptions...)
+				},
+			}
+		}
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		c.pools[addr] = pool
+	}
+	c.mu.Unlock()
+
+	return pool.Get(), nil
+}
+
+// addrForSlot returns the primary address for slot, or the empty string
+// if it is not currently known.
+func (c *Cluster) addrForSlot(slot int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addrs := c.mapping[slot]
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
+}
+
+// setAddrForSlot records addr as the new primary for slot, as learned from
+// a MOVED redirection, and feeds the MovedThreshold storm detector.
+func (c *Cluster) setAddrForSlot(slot int, addr string) {
+	c.mu.Lock()
+	c.mapping[slot] = []string{addr}
+	c.mu.Unlock()
+	c.noteMoved()
+}
+
+// randomAddr returns a random known node address, used when a Conn has not
+// been bound to a specific key yet.
+func (c *Cluster) randomAddr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := rand.Intn(hashSlots)
+	for i := 0; i < hashSlots; i++ {
+		if addrs := c.mapping[(start+i)%hashSlots]; len(addrs) > 0 {
+			return addrs[0]
+		}
+	}
+	if len(c.StartupNodes) > 0 {
+		return c.StartupNodes[rand.Intn(len(c.StartupNodes))]
+	}
+	return ""
+}
+
+// Get returns a Conn that will dispatch its commands to the appropriate
+// cluster node, determined by the first key used in a Do/Send call or via
+// an explicit call to Bind. The returned Conn must be closed after use.
+func (c *Cluster) Get() redis.Conn {
+	return &Conn{cluster: c}
+}
+
+// Close releases all the pools created by the Cluster and stops its
+// background refresh and health-check goroutines, if any.
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	closeCh := c.closeCh
+	c.closeCh = nil
+	healthCloseCh := c.healthCloseCh
+	c.healthCloseCh = nil
+
+	var err error
+	for _, pool := range c.pools {
+		if cerr := pool.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	c.pools = nil
+	c.mu.Unlock()
+
+	if closeCh != nil {
+		close(closeCh)
+	}
+	if healthCloseCh != nil {
+		close(healthCloseCh)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package redistest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// StartCluster starts a local redis-server cluster with 3 master nodes
+// (using the redis-server binary found in PATH) and returns a cleanup
+// function along with the list of ports the nodes are listening on. args,
+// if non-nil, are appended to each node's redis-server invocation (e.g. to
+// tweak cluster-node-timeout).
+//
+// The test is skipped if redis-server is not found in PATH. A failure to
+// start the nodes or to create the cluster (including a redis-server
+// without cluster support, or a missing redis-cli) fails the test.
+func StartCluster(t testing.TB, args []string) (func(), []string) {
+	t.Helper()
+
+	bin, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redistest: redis-server not found in PATH, skipping cluster test")
+	}
+
+	const nNodes = 3
+	var (
+		procs []*exec.Cmd
+		dirs  []string
+		ports []string
+	)
+
+	cleanup := func() {
+		for _, p := range procs {
+			if p.Process != nil {
+				p.Process.Kill()
+				p.Wait()
+			}
+		}
+		for _, d := range dirs {
+			os.RemoveAll(d)
+		}
+	}
+
+	for i := 0; i < nNodes; i++ {
+		port, err := freePort()
+		if err != nil {
+			cleanup()
+			t.Fatalf("redistest: failed to find a free port: %v", err)
+		}
+		dir, err := ioutil.TempDir("", "redisc-cluster-")
+		if err != nil {
+			cleanup()
+			t.Fatalf("redistest: failed to create temp dir: %v", err)
+		}
+		dirs = append(dirs, dir)
+
+		cmdArgs := []string{
+			"--port", port,
+			"--cluster-enabled", "yes",
+			"--cluster-config-file", "nodes.conf",
+			"--dir", dir,
+			"--daemonize", "no",
+			"--appendonly", "no",
+			"--save", "",
+		}
+		cmdArgs = append(cmdArgs, args...)
+
+		cmd := exec.Command(bin, cmdArgs...)
+		if err := cmd.Start(); err != nil {
+			cleanup()
+			t.Fatalf("redistest: failed to start redis-server: %v", err)
+		}
+		procs = append(procs, cmd)
+		ports = append(ports, port)
+	}
+
+	if err := waitForNodes(ports); err != nil {
+		cleanup()
+		t.Fatalf("redistest: nodes did not become ready: %v", err)
+	}
+	if err := createCluster(ports); err != nil {
+		cleanup()
+		t.Fatalf("redistest: failed to create cluster: %v", err)
+	}
+
+	return cleanup, ports
+}
+
+func freePort() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	return port, err
+}
+
+func waitForNodes(ports []string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, port := range ports {
+		for {
+			conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("node on port %s never came up: %v", port, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+func createCluster(ports []string) error {
+	cli, err := exec.LookPath("redis-cli")
+	if err != nil {
+		return err
+	}
+
+	args := []string{"--cluster", "create"}
+	for _, p := range ports {
+		args = append(args, "127.0.0.1:"+p)
+	}
+	args = append(args, "--cluster-yes")
+
+	out, err := exec.Command(cli, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
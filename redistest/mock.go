@@ -0,0 +1,166 @@
+// Package redistest provides test helpers used by the redisc package's
+// tests: a scriptable single-node mock server and a helper to start a real
+// local redis cluster for integration-style tests.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/segmentio/redisc/redistest/resp"
+)
+
+// HandlerFunc is called for each command received by a MockServer. It
+// returns the value to encode as the RESP reply: a string or []byte for a
+// bulk reply, an int64 for an integer reply, a resp.Array for an array
+// reply, a resp.Error (or error) for an error reply, or nil for a null
+// bulk reply.
+type HandlerFunc func(cmd string, args ...string) interface{}
+
+// MockServer is a single-node RESP server whose replies are entirely
+// controlled by a HandlerFunc, used to simulate specific cluster responses
+// (redirections, errors, ...) that would be hard to trigger reliably
+// against a real redis-server.
+type MockServer struct {
+	Addr string
+
+	ln net.Listener
+}
+
+// StartMockServer starts a MockServer listening on a random local port and
+// dispatching each received command to fn. It registers a cleanup function
+// on t to close the server once the test completes, but the server can
+// also be closed explicitly with Close.
+func StartMockServer(t testing.TB, fn HandlerFunc) *MockServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("redistest: failed to listen: %v", err)
+	}
+
+	s := &MockServer{
+		Addr: ln.Addr().String(),
+		ln:   ln,
+	}
+	t.Cleanup(func() { s.Close() })
+	go s.serve(fn)
+	return s
+}
+
+// Close stops the server and releases the listening socket.
+func (s *MockServer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *MockServer) serve(fn HandlerFunc) {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn, fn)
+	}
+}
+
+func (s *MockServer) handleConn(conn net.Conn, fn HandlerFunc) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		parts, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(parts) == 0 {
+			continue
+		}
+
+		reply := fn(parts[0], parts[1:]...)
+
+		buf := resp.Encode(nil, toRespValue(reply))
+		if _, err := conn.Write(buf); err != nil {
+			return
+		}
+	}
+}
+
+// toRespValue adapts values returned by a HandlerFunc into the types
+// understood by resp.Encode (in particular turning a plain Go error into a
+// resp.Error).
+func toRespValue(v interface{}) interface{} {
+	if err, ok := v.(error); ok {
+		if _, ok := v.(resp.Error); ok {
+			return v
+		}
+		return resp.Error(err.Error())
+	}
+	return v
+}
+
+// readCommand reads a single RESP request (an array of bulk strings, as
+// sent by redigo) from r.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("redistest: unexpected request line %q", line)
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		head, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(head) == 0 || head[0] != '$' {
+			return nil, fmt.Errorf("redistest: unexpected bulk header %q", head)
+		}
+		size, err := strconv.Atoi(head[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2) // +2 for the trailing \r\n
+		if _, err := readFull(r, buf); err != nil {
+			return nil, err
+		}
+		parts = append(parts, string(buf[:size]))
+	}
+	return parts, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if n := len(line); n >= 2 && line[n-2] == '\r' {
+		line = line[:n-2]
+	} else if n >= 1 {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := r.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,56 @@
+// Package resp provides minimal helpers to encode RESP (REdis Serialization
+// Protocol) values, used by redistest.MockServer to build replies from the
+// values returned by a test's handler function.
+package resp
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Error is a RESP error reply (e.g. "-ERR something\r\n"). The handler
+// function passed to redistest.StartMockServer can return a value of this
+// type to simulate an error response, including cluster redirections such
+// as "MOVED" or "ASK".
+type Error string
+
+// Array is a RESP array reply. Elements are encoded recursively: int64
+// becomes an integer reply, string becomes a bulk string, Array becomes a
+// nested array, nil becomes a null bulk string, and Error becomes an error
+// reply.
+type Array map[int]interface{}
+
+// Encode writes the RESP encoding of v to buf and returns the result.
+func Encode(buf []byte, v interface{}) []byte {
+	switch tv := v.(type) {
+	case nil:
+		return append(buf, "$-1\r\n"...)
+	case Error:
+		return append(append(buf, '-'), []byte(string(tv)+"\r\n")...)
+	case error:
+		return append(append(buf, '-'), []byte(tv.Error()+"\r\n")...)
+	case int64:
+		return append(append(buf, ':'), []byte(strconv.FormatInt(tv, 10)+"\r\n")...)
+	case string:
+		s := fmt.Sprintf("$%d\r\n%s\r\n", len(tv), tv)
+		return append(buf, s...)
+	case []byte:
+		s := fmt.Sprintf("$%d\r\n%s\r\n", len(tv), tv)
+		return append(buf, s...)
+	case Array:
+		buf = append(buf, fmt.Sprintf("*%d\r\n", len(tv))...)
+		for i := 0; i < len(tv); i++ {
+			buf = Encode(buf, tv[i])
+		}
+		return buf
+	case []interface{}:
+		buf = append(buf, fmt.Sprintf("*%d\r\n", len(tv))...)
+		for _, e := range tv {
+			buf = Encode(buf, e)
+		}
+		return buf
+	default:
+		s := fmt.Sprintf("$%d\r\n%v\r\n", len(fmt.Sprint(tv)), tv)
+		return append(buf, s...)
+	}
+}
@@ -0,0 +1,128 @@
+package redisc
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/redisc/redistest"
+	"github.com/segmentio/redisc/redistest/resp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterStatsAfterRefresh(t *testing.T) {
+	var s *redistest.MockServer
+	s = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			if len(args) > 0 && args[0] == "SHARDS" {
+				return resp.Error("ERR unknown subcommand")
+			}
+			addr, port, _ := net.SplitHostPort(s.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s.Close()
+
+	c := &Cluster{StartupNodes: []string{s.Addr}}
+	defer c.Close()
+
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.RefreshCount, "RefreshCount")
+	assert.NoError(t, stats.LastRefreshErr, "LastRefreshErr")
+	assert.False(t, stats.LastRefreshTime.IsZero(), "LastRefreshTime")
+}
+
+func TestClusterMovedThresholdTriggersRefresh(t *testing.T) {
+	var s *redistest.MockServer
+	var shardsCalls int32
+
+	s = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			if len(args) > 0 && args[0] == "SHARDS" {
+				atomic.AddInt32(&shardsCalls, 1)
+				return resp.Error("ERR unknown subcommand")
+			}
+			addr, port, _ := net.SplitHostPort(s.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s.Close()
+
+	c := &Cluster{
+		StartupNodes:   []string{s.Addr},
+		MovedThreshold: 3,
+		MovedWindow:    time.Second,
+	}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	before := atomic.LoadInt32(&shardsCalls)
+
+	for i := 0; i < 3; i++ {
+		c.setAddrForSlot(100, s.Addr)
+	}
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&shardsCalls) > before
+	}, time.Second, 10*time.Millisecond, "expected an automatic refresh after the MOVED burst")
+}
+
+func TestClusterRefreshIntervalTriggersPeriodicRefresh(t *testing.T) {
+	var s *redistest.MockServer
+	var shardsCalls int32
+
+	s = redistest.StartMockServer(t, func(cmd string, args ...string) interface{} {
+		switch cmd {
+		case "CLUSTER":
+			if len(args) > 0 && args[0] == "SHARDS" {
+				atomic.AddInt32(&shardsCalls, 1)
+				return resp.Error("ERR unknown subcommand")
+			}
+			addr, port, _ := net.SplitHostPort(s.Addr)
+			nPort, _ := strconv.Atoi(port)
+			return resp.Array{
+				0: resp.Array{0: int64(0), 1: int64(hashSlots - 1), 2: resp.Array{0: addr, 1: int64(nPort)}},
+			}
+		}
+		return resp.Error("unexpected command " + cmd)
+	})
+	defer s.Close()
+
+	c := &Cluster{
+		StartupNodes:    []string{s.Addr},
+		RefreshInterval: 10 * time.Millisecond,
+	}
+	defer c.Close()
+	require.NoError(t, c.Refresh(), "Refresh")
+
+	before := atomic.LoadInt32(&shardsCalls)
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&shardsCalls) > before
+	}, time.Second, 10*time.Millisecond, "expected a periodic background refresh")
+
+	require.NoError(t, c.Close(), "Close")
+
+	// Allow a tick already in flight when Close ran to finish, then make
+	// sure no further refreshes happen.
+	time.Sleep(20 * time.Millisecond)
+	afterClose := atomic.LoadInt32(&shardsCalls)
+	assert.Never(t, func() bool {
+		return atomic.LoadInt32(&shardsCalls) > afterClose
+	}, 100*time.Millisecond, 10*time.Millisecond, "background refresh loop should stop after Close")
+}
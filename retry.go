@@ -0,0 +1,266 @@
+package redisc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Redir describes a cluster redirection error (MOVED or ASK), as returned
+// by a node that doesn't currently serve the requested slot.
+type Redir struct {
+	Type string // "MOVED" or "ASK"
+	Slot int
+	Addr string
+}
+
+// ParseRedir parses err as a cluster redirection error and returns the
+// corresponding Redir, or nil if err is not a MOVED or ASK error.
+func ParseRedir(err error) *Redir {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	var typ string
+	switch {
+	case strings.HasPrefix(msg, "MOVED "):
+		typ = "MOVED"
+	case strings.HasPrefix(msg, "ASK "):
+		typ = "ASK"
+	default:
+		return nil
+	}
+
+	fields := strings.Fields(msg)
+	if len(fields) != 3 {
+		return nil
+	}
+	slot, err2 := strconv.Atoi(fields[1])
+	if err2 != nil {
+		return nil
+	}
+	return &Redir{Type: typ, Slot: slot, Addr: fields[2]}
+}
+
+// IsTryAgain returns true if err is a TRYAGAIN error, returned by a node
+// while a resharding operation affecting the requested key is in
+// progress.
+func IsTryAgain(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "TRYAGAIN")
+}
+
+// IsCrossSlot returns true if err is a CROSSSLOT error, returned when a
+// command's keys don't all hash to the same slot.
+func IsCrossSlot(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "CROSSSLOT")
+}
+
+// retryConn wraps a *Conn and automatically follows MOVED and ASK
+// redirections (and retries on TRYAGAIN) when executing a command via Do.
+type retryConn struct {
+	conn          *Conn
+	cluster       *Cluster
+	maxAttempts   int
+	tryAgainDelay time.Duration
+}
+
+// RetryConn wraps conn, which must be a *Conn obtained from a Cluster's
+// Get method, so that Do automatically follows MOVED and ASK
+// redirections and retries on TRYAGAIN errors, up to maxAttempts (the
+// original attempt plus retries), sleeping tryAgainDelay between
+// TRYAGAIN retries.
+func RetryConn(conn redis.Conn, maxAttempts int, tryAgainDelay time.Duration) (redis.Conn, error) {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return nil, errors.New("redisc: RetryConn requires a *redisc.Conn")
+	}
+	return &retryConn{
+		conn:          c,
+		cluster:       c.cluster,
+		maxAttempts:   maxAttempts,
+		tryAgainDelay: tryAgainDelay,
+	}, nil
+}
+
+// Do executes cmd, following MOVED/ASK redirections and retrying on
+// TRYAGAIN, up to rc.maxAttempts attempts.
+func (rc *retryConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	var (
+		lastErr error
+		addr    string
+		asking  bool
+	)
+
+	for attempt := 0; attempt < rc.maxAttempts; attempt++ {
+		var (
+			v   interface{}
+			err error
+		)
+
+		if addr == "" {
+			v, err = rc.conn.Do(cmd, args...)
+		} else {
+			conn, derr := rc.cluster.getConnForAddr(addr, false)
+			if derr != nil {
+				return nil, derr
+			}
+			if asking {
+				if _, aerr := conn.Do("ASKING"); aerr != nil {
+					conn.Close()
+					return nil, aerr
+				}
+			}
+			v, err = conn.Do(cmd, args...)
+			conn.Close()
+		}
+
+		if err == nil {
+			return v, nil
+		}
+		lastErr = err
+
+		if re := ParseRedir(err); re != nil {
+			addr = re.Addr
+			if re.Type == "MOVED" {
+				rc.cluster.setAddrForSlot(re.Slot, re.Addr)
+				asking = false
+			} else {
+				asking = true
+			}
+			continue
+		}
+
+		if IsTryAgain(err) {
+			addr = ""
+			asking = false
+			time.Sleep(rc.tryAgainDelay)
+			continue
+		}
+
+		return v, err
+	}
+
+	return nil, fmt.Errorf("redisc: too many attempts, last error: %v", lastErr)
+}
+
+// RetryConnContext behaves like RetryConn, but the returned connection
+// additionally implements ConnWithContext: DoContext honors ctx's
+// deadline across the whole operation, including every MOVED/ASK/
+// TRYAGAIN retry, and returns ctx.Err() as soon as ctx is done instead of
+// taking another attempt - in particular, a sleep between TRYAGAIN
+// retries is interrupted immediately when ctx is canceled.
+func RetryConnContext(conn redis.Conn, maxAttempts int, tryAgainDelay time.Duration) (ConnWithContext, error) {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return nil, errors.New("redisc: RetryConnContext requires a *redisc.Conn")
+	}
+	return &retryConn{
+		conn:          c,
+		cluster:       c.cluster,
+		maxAttempts:   maxAttempts,
+		tryAgainDelay: tryAgainDelay,
+	}, nil
+}
+
+// DoContext behaves like Do, bounding the whole operation - the initial
+// attempt and every retry - by ctx, as described on RetryConnContext.
+func (rc *retryConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	var (
+		lastErr error
+		addr    string
+		asking  bool
+	)
+
+	for attempt := 0; attempt < rc.maxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var (
+			v   interface{}
+			err error
+		)
+
+		if addr == "" {
+			v, err = rc.conn.DoContext(ctx, cmd, args...)
+		} else {
+			conn, derr := rc.cluster.getConnForAddr(addr, false)
+			if derr != nil {
+				return nil, derr
+			}
+			if asking {
+				if _, aerr := doWithContext(ctx, conn, "ASKING"); aerr != nil {
+					conn.Close()
+					return nil, aerr
+				}
+			}
+			v, err = doWithContext(ctx, conn, cmd, args...)
+			conn.Close()
+		}
+
+		if err == nil {
+			return v, nil
+		}
+		lastErr = err
+
+		if re := ParseRedir(err); re != nil {
+			addr = re.Addr
+			if re.Type == "MOVED" {
+				rc.cluster.setAddrForSlot(re.Slot, re.Addr)
+				asking = false
+			} else {
+				asking = true
+			}
+			continue
+		}
+
+		if IsTryAgain(err) {
+			addr = ""
+			asking = false
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(rc.tryAgainDelay):
+			}
+			continue
+		}
+
+		return v, err
+	}
+
+	return nil, fmt.Errorf("redisc: too many attempts, last error: %v", lastErr)
+}
+
+func (rc *retryConn) SendContext(ctx context.Context, cmd string, args ...interface{}) error {
+	return rc.conn.SendContext(ctx, cmd, args...)
+}
+
+func (rc *retryConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return rc.conn.ReceiveContext(ctx)
+}
+
+func (rc *retryConn) Send(cmd string, args ...interface{}) error {
+	return rc.conn.Send(cmd, args...)
+}
+
+func (rc *retryConn) Flush() error {
+	return rc.conn.Flush()
+}
+
+func (rc *retryConn) Receive() (interface{}, error) {
+	return rc.conn.Receive()
+}
+
+func (rc *retryConn) Err() error {
+	return rc.conn.Err()
+}
+
+func (rc *retryConn) Close() error {
+	return rc.conn.Close()
+}